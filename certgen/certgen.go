@@ -22,25 +22,68 @@ import (
 	"crypto/x509/pkix"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
 	"os"
 	"path/filepath"
+	"runtime/debug"
 	"time"
 
 	"github.com/hashicorp/packer-plugin-azure/builder/azure/pkcs12"
 )
 
+// version is set at build time via -ldflags "-X main.version=...".
+var version = "dev"
+
 var (
-	validFor = flag.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for")
-	outDir   = flag.String("outDir", "", "Directory to create the cert file in.")
-	hostname = flag.String("hostname", "", "Hostname to use for the self signed cert.")
+	validFor     = flag.Duration("duration", 365*24*time.Hour, "Duration that certificate is valid for")
+	outDir       = flag.String("outDir", "", "Directory to create the cert file in.")
+	hostname     = flag.String("hostname", "", "Hostname to use for the self signed cert.")
+	printVersion = flag.Bool("version", false, "Print version information and exit.")
+	verbose      = flag.Bool("verbose", false, "Also print build settings and dependencies. Only valid with -version.")
 )
 
+// writeVersion writes the certgen version to w. When verbose is set it also
+// writes the Go version, VCS build settings and module dependencies embedded
+// in the binary.
+func writeVersion(w io.Writer, verbose bool) {
+	fmt.Fprintf(w, "certgen version %s\n", version)
+	if !verbose {
+		return
+	}
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return
+	}
+	fmt.Fprintf(w, "go\t%s\n", bi.GoVersion)
+	fmt.Fprintf(w, "path\t%s\n", bi.Path)
+	for _, s := range bi.Settings {
+		fmt.Fprintf(w, "build\t%s=%s\n", s.Key, s.Value)
+	}
+	for _, d := range bi.Deps {
+		if d.Replace != nil {
+			fmt.Fprintf(w, "dep\t%s\t%s\t=> %s\t%s\n", d.Path, d.Version, d.Replace.Path, d.Replace.Version)
+			continue
+		}
+		fmt.Fprintf(w, "dep\t%s\t%s\n", d.Path, d.Version)
+	}
+}
+
 func main() {
 	flag.Parse()
 
+	if *verbose && !*printVersion {
+		fmt.Fprintln(os.Stderr, "-verbose can only be used with -version")
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *printVersion {
+		writeVersion(os.Stdout, *verbose)
+		return
+	}
+
 	var hn string
 	var err error
 	if *hostname != "" {
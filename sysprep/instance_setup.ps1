@@ -73,6 +73,140 @@ function Write-GuestAttributes {
   $client.UploadString($url, 'PUT', $Property)
 }
 
+function Get-MetadataNetworkInterfaces {
+  <#
+    .SYNOPSIS
+      Get the metadata network interface entries.
+    .DESCRIPTION
+      Wait up to 30 seconds for the metadata server and return the
+      network-interfaces/ listing. Returns $null if the metadata server
+      cannot be reached.
+  #>
+
+  $count = 1
+  do {
+    $nics = Get-Metadata -property 'network-interfaces/' -instance_only
+    if (-not $nics) {
+      Write-Log "Waiting for metadata server to read network interfaces, attempt $count."
+      if ($count++ -ge 30) {
+        return $null
+      }
+      Start-Sleep -Seconds 1
+    }
+  }
+  while (-not $nics)
+
+  return $nics
+}
+
+function Get-MetadataMtus {
+  <#
+    .SYNOPSIS
+      Get the MTU of each metadata network interface.
+    .DESCRIPTION
+      Return a hashtable mapping each metadata network interface MAC address
+      to its MTU.
+    .PARAMETER nics
+      network-interfaces/ listing from Get-MetadataNetworkInterfaces.
+  #>
+  param (
+    [Parameter(Mandatory=$true)]
+    $nics
+  )
+
+  # Hashtable keys are case insensitive, metadata reports lower case MACs.
+  $mtus = @{}
+  foreach ($nic in ($nics -split "`n")) {
+    $nic = $nic.Trim()
+    if (-not $nic) {
+      continue
+    }
+    $mac = Get-Metadata -property "network-interfaces/${nic}mac" -instance_only
+    $mtu = Get-Metadata -property "network-interfaces/${nic}mtu" -instance_only
+    if ($mac -and ($mtu -as [int])) {
+      $mtus[$mac] = [int]$mtu
+    }
+  }
+  return $mtus
+}
+
+function Set-InterfaceMtu {
+  <#
+    .SYNOPSIS
+      Set the IPv4 and IPv6 MTU of a network adapter.
+    .DESCRIPTION
+      Returns $true if the MTU was set, $false otherwise.
+    .PARAMETER adapter
+      Win32_NetworkAdapter to set the MTU on.
+    .PARAMETER mtu
+      MTU to set.
+  #>
+  param (
+    [Parameter(Mandatory=$true)]
+    $adapter,
+    [Parameter(Mandatory=$true)]
+    [int] $mtu
+  )
+
+  if ([System.Environment]::OSVersion.Version.Build -ge 10240) {
+    try {
+      Set-NetIPInterface -InterfaceIndex $adapter.InterfaceIndex -NlMtuBytes $mtu -ErrorAction Stop
+    }
+    catch {
+      Write-Log "Unable to set MTU to $mtu for interface $($adapter.InterfaceIndex) - $($adapter.Name)." -warning
+      Write-LogError
+      return $false
+    }
+    Write-Log "MTU set to $mtu for IPv4 and IPv6 using PowerShell for interface $($adapter.InterfaceIndex) - $($adapter.Name). Build $([System.Environment]::OSVersion.Version.Build)"
+  }
+  else {
+    Invoke-ExternalCommand netsh interface ipv4 set interface $adapter.NetConnectionID mtu=$mtu | Out-Null
+    $ipv4_exit_code = $LASTEXITCODE
+    Invoke-ExternalCommand netsh interface ipv6 set interface $adapter.NetConnectionID mtu=$mtu | Out-Null
+    if ($ipv4_exit_code -ne 0 -or $LASTEXITCODE -ne 0) {
+      Write-Log "Unable to set MTU to $mtu using netsh for interface $($adapter.NetConnectionID) - $($adapter.Name)." -warning
+      return $false
+    }
+    Write-Log "MTU set to $mtu for IPv4 and IPv6 using netsh for interface $($adapter.NetConnectionID) - $($adapter.Name)."
+  }
+  return $true
+}
+
+function Test-InstanceSetupDone {
+  <#
+    .SYNOPSIS
+      Check if instance setup already ran on this instance.
+    .DESCRIPTION
+      Uses the completion markers every image generation leaves behind, so
+      upgraded old images are recognized as well. The specialize phase only
+      runs while Windows setup is in progress, and the first boot run is
+      launched by SetupComplete.cmd, which instance setup deletes once done.
+    .PARAMETER specialize
+      Check for the sysprep specialize phase.
+  #>
+  param (
+    [switch] $specialize
+  )
+
+  if ($specialize) {
+    try {
+      $in_progress = (Get-ItemProperty -Path 'HKLM:\SYSTEM\Setup' -Name 'SystemSetupInProgress' -ErrorAction Stop).SystemSetupInProgress
+    }
+    catch {
+      return $false
+    }
+    if ($in_progress -eq 0) {
+      Write-Log 'Windows setup is not in progress.'
+      return $true
+    }
+  }
+  elseif (-not (Test-Path $script:setupcomplete_loc)) {
+    Write-Log "$script:setupcomplete_loc does not exist."
+    return $true
+  }
+  return $false
+}
+
 function Change-InstanceName {
   <#
     .SYNOPSIS
@@ -172,20 +306,59 @@ function Change-InstanceProperties {
   }
 
   if ($interface -ne $null) {
+    # Add the metadata route before any of the metadata reads below.
+    Invoke-ExternalCommand route /p add 169.254.169.254 mask 255.255.255.255 0.0.0.0 if $interface[0].InterfaceIndex metric 1 -ErrorAction SilentlyContinue
+    Write-Log "Added persistent route to metadata netblock to $($interface.ServiceName) adapter."
+
+    # Wait for the metadata server before reading disable-metadata-mtu so an
+    # unreachable server isn't mistaken for the attribute being unset.
+    $default_mtu = 1460
+    $mtus = $null
+    $metadata_nics = Get-MetadataNetworkInterfaces
+    if ($null -eq $metadata_nics) {
+      Write-Log "Unable to read network interfaces from metadata, falling back to MTU $default_mtu." -warning
+    }
+    elseif ((Get-Metadata -property 'attributes/disable-metadata-mtu') -eq 'true') {
+      Write-Log "disable-metadata-mtu is set, using MTU $default_mtu for all interfaces."
+    }
+    else {
+      $mtus = Get-MetadataMtus -nics $metadata_nics
+    }
+
     $interface | ForEach-Object {
-      if ([System.Environment]::OSVersion.Version.Build -ge 10240) {
-        Set-NetIPInterface -InterfaceIndex $_.InterfaceIndex -NlMtuBytes 1460
-        Write-Log "MTU set to 1460 for IPv4 and IPv6 using PowerShell for interface $($_.InterfaceIndex) - $($_.Name). Build $([System.Environment]::OSVersion.Version.Build)"
+      $mtu = $default_mtu
+      if ($null -ne $mtus) {
+        if ($_.MACAddress -and $mtus.ContainsKey($_.MACAddress)) {
+          $mtu = $mtus[$_.MACAddress]
+        }
+        else {
+          Write-Log "No metadata MTU for interface $($_.InterfaceIndex) with MAC $($_.MACAddress), falling back to MTU $default_mtu." -warning
+        }
       }
-      else {
-        Invoke-ExternalCommand netsh interface ipv4 set interface $_.NetConnectionID mtu=1460 | Out-Null
-        Invoke-ExternalCommand netsh interface ipv6 set interface $_.NetConnectionID mtu=1460 | Out-Null
-        Write-Log "MTU set to 1460 for IPv4 and IPv6 using netsh for interface $($_.NetConnectionID) - $($_.Name)."
+
+      # Don't exceed what the adapter's link layer (jumbo packet setting) supports.
+      if ($mtu -gt $default_mtu) {
+        try {
+          $link_mtu = (Get-NetAdapter -InterfaceIndex $_.InterfaceIndex -ErrorAction Stop).MtuSize
+        }
+        catch {
+          $link_mtu = $null
+        }
+        if (-not $link_mtu) {
+          Write-Log "Unable to read the link MTU of interface $($_.InterfaceIndex) - $($_.Name), falling back to MTU $default_mtu." -warning
+          $mtu = $default_mtu
+        }
+        elseif ($mtu -gt $link_mtu) {
+          Write-Log "Metadata MTU $mtu exceeds the link MTU $link_mtu of interface $($_.InterfaceIndex) - $($_.Name), falling back to MTU $default_mtu." -warning
+          $mtu = $default_mtu
+        }
+      }
+
+      if (-not (Set-InterfaceMtu -adapter $_ -mtu $mtu) -and $mtu -ne $default_mtu) {
+        Write-Log "Falling back to MTU $default_mtu for interface $($_.InterfaceIndex) - $($_.Name)." -warning
+        Set-InterfaceMtu -adapter $_ -mtu $default_mtu | Out-Null
       }
     }
-  
-    Invoke-ExternalCommand route /p add 169.254.169.254 mask 255.255.255.255 0.0.0.0 if $interface[0].InterfaceIndex metric 1 -ErrorAction SilentlyContinue
-    Write-Log "Added persistent route to metadata netblock to $($interface.ServiceName) adapter."
   }
   else {
     Write-Log 'Error identifying network adapter as gVNIC or VirtIO, unable to set MTU and route to metadata server.'
@@ -270,6 +443,12 @@ if (-not ($global:write_to_serial)) {
   Write-Log 'COM1 does not exist on this machine. Logs will not be written to GCE console.'
 }
 
+# Don't re-run setup on instances where it already completed.
+if (Test-InstanceSetupDone -specialize:$specialize) {
+  Write-Log 'Instance setup already completed, skipping.'
+  exit 0
+}
+
 Write-Log 'Enable google_osconfig_agent during the specialize configuration pass.'
 Set-Service google_osconfig_agent -StartupType Automatic -Verbose -ErrorAction Continue
 